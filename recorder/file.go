@@ -0,0 +1,162 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package recorder provides ssh.Recorder implementations that persist
+// piped session channels as terminal recordings.
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// asciinemaHeader is the asciinema v2 file header, written as the first
+// line of the recording.
+type asciinemaHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type fileSession struct {
+	f     *os.File
+	start time.Time
+	wrote bool
+	mu    sync.Mutex
+}
+
+// FileRecorder writes each session to its own asciinema v2 (.cast) file
+// under Dir, named by the session id.
+type FileRecorder struct {
+	Dir string
+
+	mu       sync.Mutex
+	sessions map[string]*fileSession
+}
+
+// NewFileRecorder returns a Recorder that writes asciinema v2 recordings
+// into dir, creating it if necessary.
+func NewFileRecorder(dir string) (*FileRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileRecorder{Dir: dir, sessions: map[string]*fileSession{}}, nil
+}
+
+func (r *FileRecorder) path(sessionID string) string {
+	return filepath.Join(r.Dir, sessionID+".cast")
+}
+
+// Open implements ssh.Recorder.
+func (r *FileRecorder) Open(sessionID string, width, height uint32) error {
+	f, err := os.OpenFile(r.path(sessionID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if width == 0 {
+		width = 80
+	}
+	if height == 0 {
+		height = 24
+	}
+
+	header := asciinemaHeader{
+		Version:   2,
+		Width:     int(width),
+		Height:    int(height),
+		Timestamp: time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	r.mu.Lock()
+	r.sessions[sessionID] = &fileSession{f: f, start: time.Now()}
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *FileRecorder) session(sessionID string) *fileSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[sessionID]
+}
+
+// Write implements ssh.Recorder, appending an asciinema v2 "output"
+// event. Stderr data is recorded under the same "o" stream, as asciinema
+// v2 does not distinguish the two.
+func (r *FileRecorder) Write(sessionID string, stderr bool, data []byte) error {
+	s := r.session(sessionID)
+	if s == nil {
+		return fmt.Errorf("recorder: unknown session %v", sessionID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event := []interface{}{time.Since(s.start).Seconds(), "o", string(data)}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.wrote = true
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+// WindowChange implements ssh.Recorder, appending an asciinema v2
+// "resize" event.
+func (r *FileRecorder) WindowChange(sessionID string, width, height uint32) error {
+	s := r.session(sessionID)
+	if s == nil {
+		return fmt.Errorf("recorder: unknown session %v", sessionID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event := []interface{}{time.Since(s.start).Seconds(), "r", fmt.Sprintf("%dx%d", width, height)}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+// Close implements ssh.Recorder.
+func (r *FileRecorder) Close(sessionID string) error {
+	r.mu.Lock()
+	s, ok := r.sessions[sessionID]
+	if ok {
+		delete(r.sessions, sessionID)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return s.f.Close()
+}
@@ -0,0 +1,106 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+func init() {
+	Register("exec", newExecProvider)
+}
+
+// routeRequest is the JSON document written to a provider's stdin (exec)
+// or POST body (http) describing the connection to be routed.
+type routeRequest struct {
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// routeResponse is the JSON document a provider writes back, naming the
+// upstream to dial and the auth material to use against it.
+type routeResponse struct {
+	UpstreamAddr string `json:"upstream_addr"`
+	UpstreamUser string `json:"upstream_user"`
+	SignerRef    string `json:"signer_ref"`
+	KnownHosts   string `json:"known_hosts"`
+}
+
+type execProviderConfig struct {
+	Command string        `json:"command" yaml:"command"`
+	Args    []string      `json:"args" yaml:"args"`
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// execProvider resolves upstreams by running an external program, writing
+// a routeRequest to its stdin and reading a routeResponse from its
+// stdout. This is the same contract as OpenSSH's AuthorizedKeysCommand.
+type execProvider struct {
+	cfg execProviderConfig
+}
+
+func newExecProvider(raw json.RawMessage) (ssh.UpstreamProvider, error) {
+	var cfg execProviderConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("exec provider: %v", err)
+	}
+
+	if cfg.Command == "" {
+		return nil, fmt.Errorf("exec provider: command is required")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	return &execProvider{cfg: cfg}, nil
+}
+
+func (p *execProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, string, *ssh.UpstreamAuth, error) {
+	reqBody, err := json.Marshal(routeRequest{
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.cfg.Command, p.cfg.Args...)
+	cmd.Stdin = bytes.NewReader(reqBody)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("exec provider: %v", err)
+	}
+
+	var resp routeResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, "", nil, fmt.Errorf("exec provider: bad response: %v", err)
+	}
+
+	c, err := net.Dial("tcp", resp.UpstreamAddr)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var known []string
+	if resp.KnownHosts != "" {
+		known = []string{resp.KnownHosts}
+	}
+
+	return c, resp.UpstreamUser, &ssh.UpstreamAuth{SignerRef: resp.SignerRef, KnownHosts: known}, nil
+}
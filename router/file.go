@@ -0,0 +1,101 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+func init() {
+	Register("file", newFileProvider)
+}
+
+// fileRule maps a downstream connection to an upstream target. A rule
+// matches a connection when DownstreamUser is empty or equal to the
+// authenticating user, and SrcCIDR is empty or contains the downstream's
+// remote address.
+type fileRule struct {
+	DownstreamUser string `json:"downstream_user" yaml:"downstream_user"`
+	SrcCIDR        string `json:"src_cidr" yaml:"src_cidr"`
+
+	UpstreamAddr string `json:"upstream_addr" yaml:"upstream_addr"`
+	UpstreamUser string `json:"upstream_user" yaml:"upstream_user"`
+	SignerRef    string `json:"signer_ref" yaml:"signer_ref"`
+	KnownHosts   string `json:"known_hosts" yaml:"known_hosts"`
+
+	cidr *net.IPNet
+}
+
+type fileProviderConfig struct {
+	Rules []fileRule `json:"rules" yaml:"rules"`
+}
+
+// fileProvider resolves upstreams from a static table of rules, the
+// config format asked for by most deployments that just want a lookup
+// table mapping downstream users (and optionally source networks) to
+// upstream servers.
+type fileProvider struct {
+	rules []fileRule
+}
+
+func newFileProvider(raw json.RawMessage) (ssh.UpstreamProvider, error) {
+	var cfg fileProviderConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("file provider: %v", err)
+	}
+
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.SrcCIDR == "" {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(r.SrcCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("file provider: rule %d: %v", i, err)
+		}
+
+		r.cidr = ipnet
+	}
+
+	return &fileProvider{rules: cfg.Rules}, nil
+}
+
+func (p *fileProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, string, *ssh.UpstreamAuth, error) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	ip := net.ParseIP(host)
+
+	for _, r := range p.rules {
+		if r.DownstreamUser != "" && r.DownstreamUser != conn.User() {
+			continue
+		}
+
+		if r.cidr != nil && (ip == nil || !r.cidr.Contains(ip)) {
+			continue
+		}
+
+		c, err := net.Dial("tcp", r.UpstreamAddr)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		var known []string
+		if r.KnownHosts != "" {
+			known = []string{r.KnownHosts}
+		}
+
+		return c, r.UpstreamUser, &ssh.UpstreamAuth{SignerRef: r.SignerRef, KnownHosts: known}, nil
+	}
+
+	return nil, "", nil, fmt.Errorf("file provider: no rule matched user %q", conn.User())
+}
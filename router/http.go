@@ -0,0 +1,87 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+func init() {
+	Register("http", newHTTPProvider)
+}
+
+type httpProviderConfig struct {
+	URL     string        `json:"url" yaml:"url"`
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+}
+
+// httpProvider resolves upstreams by POSTing a routeRequest to a webhook
+// and reading back a routeResponse.
+type httpProvider struct {
+	cfg    httpProviderConfig
+	client *http.Client
+}
+
+func newHTTPProvider(raw json.RawMessage) (ssh.UpstreamProvider, error) {
+	var cfg httpProviderConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("http provider: %v", err)
+	}
+
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("http provider: url is required")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	return &httpProvider{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+func (p *httpProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, string, *ssh.UpstreamAuth, error) {
+	body, err := json.Marshal(routeRequest{
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	resp, err := p.client.Post(p.cfg.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("http provider: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil, fmt.Errorf("http provider: webhook returned %v", resp.Status)
+	}
+
+	var out routeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, "", nil, fmt.Errorf("http provider: bad response: %v", err)
+	}
+
+	c, err := net.Dial("tcp", out.UpstreamAddr)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var known []string
+	if out.KnownHosts != "" {
+		known = []string{out.KnownHosts}
+	}
+
+	return c, out.UpstreamUser, &ssh.UpstreamAuth{SignerRef: out.SignerRef, KnownHosts: known}, nil
+}
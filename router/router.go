@@ -0,0 +1,258 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package router implements a declarative upstream-provider subsystem for
+// sshpiperd. Instead of hard-coding SSHPiperConfig.FindUpstream in Go,
+// deployments describe routing rules in a YAML or JSON config file and
+// SSHPiper picks an upstream for each connection at runtime, reloading the
+// rules whenever the file changes.
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]Factory{}
+)
+
+// Factory builds an ssh.UpstreamProvider from its raw configuration block.
+// Built-in providers (file, exec, http) register a Factory in their
+// init(); third-party providers can Register their own under a distinct
+// name.
+type Factory func(cfg json.RawMessage) (ssh.UpstreamProvider, error)
+
+// Register makes a provider factory available under name. It panics if
+// name is already registered or factory is nil, mirroring database/sql.
+func Register(name string, factory Factory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if factory == nil {
+		panic("router: Register factory is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("router: Register called twice for provider " + name)
+	}
+	providers[name] = factory
+}
+
+func lookup(name string) (Factory, bool) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	f, ok := providers[name]
+	return f, ok
+}
+
+// ProviderConfig is one entry of a Config's provider chain.
+type ProviderConfig struct {
+	Type   string          `json:"type" yaml:"type"`
+	Config json.RawMessage `json:"config" yaml:"config"`
+}
+
+// Config is the top level layout of a router config file.
+type Config struct {
+	// Providers are tried in order; the first one that resolves an
+	// upstream for the connection wins.
+	Providers []ProviderConfig `json:"providers" yaml:"providers"`
+}
+
+// parseYAMLConfig decodes a YAML router config into Config. yaml.v2
+// cannot unmarshal a nested mapping straight into a json.RawMessage
+// ([]byte) field, so each provider's "config" block is decoded generically
+// and re-marshaled to JSON, giving factories the same json.RawMessage
+// shape the JSON config path produces.
+func parseYAMLConfig(data []byte) (Config, error) {
+	var raw struct {
+		Providers []struct {
+			Type   string      `yaml:"type"`
+			Config interface{} `yaml:"config"`
+		} `yaml:"providers"`
+	}
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{Providers: make([]ProviderConfig, 0, len(raw.Providers))}
+	for _, p := range raw.Providers {
+		b, err := json.Marshal(normalizeYAML(p.Config))
+		if err != nil {
+			return Config{}, fmt.Errorf("provider %q: %v", p.Type, err)
+		}
+
+		cfg.Providers = append(cfg.Providers, ProviderConfig{Type: p.Type, Config: b})
+	}
+
+	return cfg, nil
+}
+
+// normalizeYAML recursively converts the map[interface{}]interface{}
+// values yaml.v2 produces into map[string]interface{}, the shape
+// encoding/json can marshal, leaving slices and scalars untouched aside
+// from recursing into their elements.
+func normalizeYAML(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalizeYAML(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// Router is an ssh.UpstreamProvider backed by a config file. It loads the
+// chain of providers described by the file and, once Watch is called,
+// reloads that chain whenever the file changes so routing edits take
+// effect without restarting sshpiperd.
+type Router struct {
+	path string
+
+	mu    sync.RWMutex
+	chain []ssh.UpstreamProvider
+
+	watcher *fsnotify.Watcher
+}
+
+// New loads the provider chain described by the config file at path. The
+// file format (YAML or JSON) is picked from its extension.
+func New(path string) (*Router, error) {
+	r := &Router{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Router) reload() error {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var cfg Config
+	if strings.HasSuffix(r.path, ".json") {
+		err = json.Unmarshal(data, &cfg)
+	} else {
+		cfg, err = parseYAMLConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("router: parse %v: %v", r.path, err)
+	}
+
+	chain := make([]ssh.UpstreamProvider, 0, len(cfg.Providers))
+	for _, pc := range cfg.Providers {
+		factory, ok := lookup(pc.Type)
+		if !ok {
+			return fmt.Errorf("router: unknown provider %q", pc.Type)
+		}
+
+		p, err := factory(pc.Config)
+		if err != nil {
+			return fmt.Errorf("router: init provider %q: %v", pc.Type, err)
+		}
+
+		chain = append(chain, p)
+	}
+
+	r.mu.Lock()
+	r.chain = chain
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Watch starts watching the config file for changes, reloading the
+// provider chain whenever it is written. Reload errors are logged and
+// leave the previously loaded chain in place.
+func (r *Router) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := w.Add(filepath.Dir(r.path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	r.watcher = w
+
+	go func() {
+		for event := range w.Events {
+			if filepath.Clean(event.Name) != filepath.Clean(r.path) {
+				continue
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			if err := r.reload(); err != nil {
+				log.Printf("router: reload %v: %v", r.path, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the config file.
+func (r *Router) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+
+	return r.watcher.Close()
+}
+
+// FindUpstream implements ssh.UpstreamProvider by trying each provider in
+// the chain in order and returning the first one that resolves an
+// upstream without error.
+func (r *Router) FindUpstream(conn ssh.ConnMetadata) (net.Conn, string, *ssh.UpstreamAuth, error) {
+	r.mu.RLock()
+	chain := r.chain
+	r.mu.RUnlock()
+
+	var lastErr error
+	for _, p := range chain {
+		c, user, auth, err := p.FindUpstream(conn)
+		if err == nil {
+			return c, user, auth, nil
+		}
+
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("router: no provider matched user %q", conn.User())
+	}
+
+	return nil, "", nil, lastErr
+}
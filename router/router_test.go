@@ -0,0 +1,65 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseYAMLConfigDecodesNestedProviderConfig(t *testing.T) {
+	data := []byte(`
+providers:
+  - type: file
+    config:
+      rules:
+        - downstream_user: alice
+          upstream_addr: 10.0.0.1:22
+          upstream_user: root
+`)
+
+	cfg, err := parseYAMLConfig(data)
+	if err != nil {
+		t.Fatalf("parseYAMLConfig: %v", err)
+	}
+
+	if len(cfg.Providers) != 1 {
+		t.Fatalf("got %d providers, want 1", len(cfg.Providers))
+	}
+
+	if cfg.Providers[0].Type != "file" {
+		t.Fatalf("got provider type %q, want %q", cfg.Providers[0].Type, "file")
+	}
+
+	var decoded fileProviderConfig
+	if err := json.Unmarshal(cfg.Providers[0].Config, &decoded); err != nil {
+		t.Fatalf("provider config did not round-trip to JSON: %v", err)
+	}
+
+	if len(decoded.Rules) != 1 || decoded.Rules[0].UpstreamAddr != "10.0.0.1:22" {
+		t.Fatalf("got rules %+v, want one rule for 10.0.0.1:22", decoded.Rules)
+	}
+}
+
+func TestNormalizeYAMLConvertsNestedMaps(t *testing.T) {
+	in := map[interface{}]interface{}{
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"downstream_user": "alice",
+			},
+		},
+	}
+
+	out, err := json.Marshal(normalizeYAML(in))
+	if err != nil {
+		t.Fatalf("marshal normalized value: %v", err)
+	}
+
+	want := `{"rules":[{"downstream_user":"alice"}]}`
+	if string(out) != want {
+		t.Fatalf("got %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package signer provides ssh.Signer backends for MapPublicKey that keep
+// the upstream private key out of the piper process: an ssh-agent backed
+// signer and a PKCS#11 (HSM/smartcard) backed signer.
+package signer
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	agentssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+// agentSigner signs on behalf of a key held by a remote ssh-agent, the
+// same pattern Terraform's ssh communicator uses with agent_identity to
+// pick a specific key out of the agent.
+type agentSigner struct {
+	dialer func() (net.Conn, error)
+	pubkey ssh.PublicKey
+}
+
+// NewAgentSigner returns a Signer that asks the ssh-agent reachable via
+// dialer to sign on behalf of pubkey, so the piper process never loads
+// the matching private key. dialer is invoked once per signature; use
+// NewSocketDialer for a local or remote SSH_AUTH_SOCK, or a dialer that
+// returns the downstream's forwarded agent channel (opened via
+// auth-agent-req@openssh.com, see ChannelPolicy.AllowAgentForwarding) to
+// sign with a key the downstream client holds instead.
+func NewAgentSigner(dialer func() (net.Conn, error), pubkey ssh.PublicKey) (ssh.Signer, error) {
+	return &agentSigner{dialer: dialer, pubkey: pubkey}, nil
+}
+
+// NewSocketDialer returns a dialer for NewAgentSigner that dials the
+// unix socket at path, typically the value of SSH_AUTH_SOCK.
+func NewSocketDialer(path string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pubkey
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgo(rand, data, s.pubkey.Type())
+}
+
+// SupportedAlgos implements ssh.AlgoSigner. Agents predate the RSA
+// SHA-2 extension (RFC 8332) far more often than the keys they hold do,
+// so an RSA key only advertises rsa-sha2-256 ahead of the legacy
+// ssh-rsa, never rsa-sha2-512, which many agents still reject.
+func (s *agentSigner) SupportedAlgos() []string {
+	if s.pubkey.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{s.pubkey.Type()}
+}
+
+// SignWithAlgo implements ssh.AlgoSigner.
+func (s *agentSigner) SignWithAlgo(rand io.Reader, data []byte, algo string) (*ssh.Signature, error) {
+	conn, err := s.dialer()
+	if err != nil {
+		return nil, fmt.Errorf("agent signer: dial: %v", err)
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+
+	// s.pubkey is this repo's forked ssh.PublicKey, not the
+	// golang.org/x/crypto/ssh.PublicKey the agent package talks in.
+	// Round-trip through the wire format to cross the boundary.
+	agentKey, err := agentssh.ParsePublicKey(s.pubkey.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("agent signer: parse public key: %v", err)
+	}
+
+	if algo == s.pubkey.Type() {
+		sig, err := client.Sign(agentKey, data)
+		if err != nil {
+			return nil, err
+		}
+		return toForkSignature(sig), nil
+	}
+
+	extended, ok := client.(agent.ExtendedAgent)
+	if !ok {
+		return nil, fmt.Errorf("agent signer: agent does not support algorithm %q", algo)
+	}
+
+	sig, err := extended.SignWithFlags(agentKey, data, algoSignFlag(algo))
+	if err != nil {
+		return nil, err
+	}
+	return toForkSignature(sig), nil
+}
+
+// toForkSignature converts a golang.org/x/crypto/ssh.Signature, as
+// returned by the agent package, into this repo's forked ssh.Signature.
+func toForkSignature(sig *agentssh.Signature) *ssh.Signature {
+	return &ssh.Signature{
+		Format: sig.Format,
+		Blob:   sig.Blob,
+		Rest:   sig.Rest,
+	}
+}
+
+func algoSignFlag(algo string) agent.SignatureFlags {
+	switch algo {
+	case ssh.KeyAlgoRSASHA256:
+		return agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		return agent.SignatureFlagRsaSha512
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package signer
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+// pkcs11Signer signs using an RSA private key that never leaves an HSM
+// or smartcard, reached through a PKCS#11 module.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	keyID   []byte
+	pubkey  ssh.PublicKey
+}
+
+// NewPKCS11Signer opens the PKCS#11 module at modulePath, logs into the
+// token labeled tokenLabel with pin, and returns a Signer backed by the
+// RSA private key object whose CKA_ID equals keyID.
+func NewPKCS11Signer(modulePath, tokenLabel, pin string, keyID []byte) (ssh.Signer, error) {
+	ctx := pkcs11.New(modulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11 signer: unable to load module %v", modulePath)
+	}
+
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("pkcs11 signer: initialize: %v", err)
+	}
+
+	slot, err := findSlotByTokenLabel(ctx, tokenLabel)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11 signer: open session: %v", err)
+	}
+
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11 signer: login: %v", err)
+	}
+
+	pub, err := publicKeyForID(ctx, session, keyID)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	return &pkcs11Signer{ctx: ctx, session: session, keyID: keyID, pubkey: pub}, nil
+}
+
+func (s *pkcs11Signer) PublicKey() ssh.PublicKey {
+	return s.pubkey
+}
+
+func (s *pkcs11Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgo(rand, data, ssh.KeyAlgoRSASHA256)
+}
+
+// SupportedAlgos implements ssh.AlgoSigner. The HSM sessions this signer
+// is built for hash-and-sign in a single CKM_SHA256_RSA_PKCS call, so
+// only rsa-sha2-256 is offered.
+func (s *pkcs11Signer) SupportedAlgos() []string {
+	return []string{ssh.KeyAlgoRSASHA256}
+}
+
+// SignWithAlgo implements ssh.AlgoSigner.
+func (s *pkcs11Signer) SignWithAlgo(rand io.Reader, data []byte, algo string) (*ssh.Signature, error) {
+	if algo != ssh.KeyAlgoRSASHA256 {
+		return nil, fmt.Errorf("pkcs11 signer: unsupported algorithm %q", algo)
+	}
+
+	priv, err := findPrivateKey(s.ctx, s.session, s.keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)}
+	if err := s.ctx.SignInit(s.session, mech, priv); err != nil {
+		return nil, fmt.Errorf("pkcs11 signer: sign init: %v", err)
+	}
+
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 signer: sign: %v", err)
+	}
+
+	return &ssh.Signature{Format: ssh.KeyAlgoRSASHA256, Blob: sig}, nil
+}
+
+func findSlotByTokenLabel(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11 signer: list slots: %v", err)
+	}
+
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pkcs11 signer: no token labeled %q", label)
+}
+
+func findPrivateKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, keyID []byte) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+	}
+
+	return findObject(ctx, session, template)
+}
+
+func publicKeyForID(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, keyID []byte) (ssh.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+	}
+
+	obj, err := findObject(ctx, session, template)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11 signer: read public key: %v", err)
+	}
+
+	return rsaPublicKeyFromAttrs(attrs[0].Value, attrs[1].Value)
+}
+
+func findObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("pkcs11 signer: find objects init: %v", err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11 signer: find objects: %v", err)
+	}
+
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("pkcs11 signer: no matching key object")
+	}
+
+	return objs[0], nil
+}
+
+func rsaPublicKeyFromAttrs(modulus, exponent []byte) (ssh.PublicKey, error) {
+	pub := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+
+	return ssh.NewPublicKey(pub)
+}
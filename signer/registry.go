@@ -0,0 +1,50 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package signer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]ssh.Signer{}
+)
+
+// Register makes s available under ref for ssh.SSHPiperConfig.SignerForRef
+// (Lookup) to find, e.g. a route's signer_ref naming an ssh-agent or
+// PKCS#11 backed signer built with NewAgentSigner or NewPKCS11Signer. It
+// panics if ref is already registered or s is nil, mirroring
+// router.Register.
+func Register(ref string, s ssh.Signer) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if s == nil {
+		panic("signer: Register signer is nil")
+	}
+	if _, dup := registry[ref]; dup {
+		panic("signer: Register called twice for ref " + ref)
+	}
+	registry[ref] = s
+}
+
+// Lookup resolves ref, as registered with Register, into a Signer. It is
+// an ssh.SSHPiperConfig.SignerForRef implementation.
+func Lookup(ref string) (ssh.Signer, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	s, ok := registry[ref]
+	if !ok {
+		return nil, fmt.Errorf("signer: no signer registered for ref %q", ref)
+	}
+
+	return s, nil
+}
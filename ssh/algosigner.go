@@ -0,0 +1,45 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import "io"
+
+// AlgoSigner is implemented by a Signer that can produce a signature
+// using a caller-chosen algorithm for its key type, mirroring OpenSSH's
+// RSA SHA-2 signature extension (RFC 8332): an RSA key can sign with
+// "ssh-rsa", "rsa-sha2-256" or "rsa-sha2-512", and not every signer
+// backend (e.g. an older ssh-agent) supports every variant.
+type AlgoSigner interface {
+	Signer
+
+	// SupportedAlgos returns the algorithm names this signer can produce
+	// a signature for, most preferred first.
+	SupportedAlgos() []string
+
+	// SignWithAlgo signs data using algo, which must be one of the names
+	// returned by SupportedAlgos.
+	SignWithAlgo(rand io.Reader, data []byte, algo string) (*Signature, error)
+}
+
+// negotiateAlgo picks the signature algorithm signAgain should present
+// to upstream for signer/key: the signer's own preference if it
+// implements AlgoSigner, so a restricted backend (e.g. an agent key that
+// can't do rsa-sha2-512) is never asked for an algorithm it can't
+// produce, or the key type otherwise.
+func negotiateAlgo(signer Signer, key PublicKey) string {
+	as, ok := signer.(AlgoSigner)
+	if !ok {
+		return key.Type()
+	}
+
+	for _, algo := range as.SupportedAlgos() {
+		if isAcceptableAlgo(algo) {
+			return algo
+		}
+	}
+
+	return key.Type()
+}
@@ -0,0 +1,640 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditEventType names the kind of action an AuditEvent records.
+type AuditEventType string
+
+// The audit event types emitted by the piped channel proxy.
+const (
+	AuditChannelOpen    AuditEventType = "channel_open"
+	AuditChannelRequest AuditEventType = "channel_request"
+	AuditChannelEOF     AuditEventType = "channel_eof"
+	AuditChannelClose   AuditEventType = "channel_close"
+)
+
+// AuditEvent is a single structured audit record emitted once user auth
+// has succeeded, one per channel-open, channel-request (session, exec,
+// shell, subsystem, pty-req, env, x11-req, direct-tcpip/forwarded-tcpip,
+// exit-status) and channel-close observed on the piped connection.
+type AuditEvent struct {
+	Type           AuditEventType `json:"type"`
+	Time           time.Time      `json:"time"`
+	SessionID      string         `json:"session_id"`
+	DownstreamUser string         `json:"downstream_user"`
+	UpstreamUser   string         `json:"upstream_user"`
+	RemoteAddr     string         `json:"remote_addr"`
+	ChannelType    string         `json:"channel_type,omitempty"`
+	RequestType    string         `json:"request_type,omitempty"`
+	Command        string         `json:"command,omitempty"`
+	ExitStatus     *uint32        `json:"exit_status,omitempty"`
+}
+
+// Recorder persists the terminal output of piped "session" channels, for
+// example as asciinema v2 recordings. Implementations must tolerate Write
+// being called for a sessionID that was never Open'd and must be safe for
+// concurrent use across sessions.
+type Recorder interface {
+	// Open is called once for a session channel, when upstream confirms
+	// the channel open and before any Write for that sessionID. width and
+	// height are always zero here: the channel's pty-req comes later and
+	// its size is passed to WindowChange.
+	Open(sessionID string, width, height uint32) error
+
+	// Write appends raw bytes read from the session channel. stderr is
+	// true for SSH_MSG_CHANNEL_EXTENDED_DATA of type
+	// SSH_EXTENDED_DATA_STDERR.
+	Write(sessionID string, stderr bool, data []byte) error
+
+	// WindowChange records the pty size from a pty-req or a later
+	// window-change request.
+	WindowChange(sessionID string, width, height uint32) error
+
+	// Close finalizes and flushes the recording for a session.
+	Close(sessionID string) error
+}
+
+// auditedChannel tracks the state the auditor needs to interpret
+// messages for one channel across both directions of the pipe: PeersID
+// in a message from downstream addresses the channel number upstream
+// assigned to it (upID), while a message from upstream addresses the
+// number downstream assigned (downID).
+type auditedChannel struct {
+	sessionID string
+	chanType  string
+	downID    uint32
+	upID      uint32
+	confirmed bool
+	recording bool
+}
+
+// channelAuditor inspects the piped packet stream in both directions to
+// emit AuditEvents and feed a Recorder, without altering the bytes that
+// get forwarded.
+type channelAuditor struct {
+	hook     func(AuditEvent)
+	recorder Recorder
+	policy   ChannelPolicy
+	conn     ConnMetadata
+	metrics  MetricsHook
+
+	connSessionID  string
+	downstreamUser string
+	upstreamUser   string
+	remoteAddr     string
+
+	seq uint64
+
+	mu     sync.Mutex
+	byDown map[uint32]*auditedChannel
+	byUp   map[uint32]*auditedChannel
+}
+
+func newChannelAuditor(hook func(AuditEvent), recorder Recorder, policy ChannelPolicy, metrics MetricsHook, connSessionID string, conn ConnMetadata, downstreamUser, upstreamUser string, remote net.Addr) *channelAuditor {
+	if policy == nil {
+		policy = ForwardAllPolicy{}
+	}
+
+	a := &channelAuditor{
+		hook:           hook,
+		recorder:       recorder,
+		policy:         policy,
+		conn:           conn,
+		metrics:        metrics,
+		connSessionID:  connSessionID,
+		downstreamUser: downstreamUser,
+		upstreamUser:   upstreamUser,
+		byDown:         map[uint32]*auditedChannel{},
+		byUp:           map[uint32]*auditedChannel{},
+	}
+
+	if remote != nil {
+		a.remoteAddr = remote.String()
+	}
+
+	return a
+}
+
+func (a *channelAuditor) emit(typ AuditEventType, ch *auditedChannel, requestType, command string, exitStatus *uint32) {
+	if a == nil || a.hook == nil {
+		return
+	}
+
+	event := AuditEvent{
+		Type:           typ,
+		Time:           time.Now(),
+		DownstreamUser: a.downstreamUser,
+		UpstreamUser:   a.upstreamUser,
+		RemoteAddr:     a.remoteAddr,
+		RequestType:    requestType,
+		Command:        command,
+		ExitStatus:     exitStatus,
+	}
+
+	if ch != nil {
+		event.SessionID = ch.sessionID
+		event.ChannelType = ch.chanType
+	}
+
+	a.hook(event)
+}
+
+// emitMetrics forwards a MetricsEvent to a.metrics, filling in the fields
+// common to every event this auditor reports.
+func (a *channelAuditor) emitMetrics(typ MetricsEventType, ch *auditedChannel, direction string, bytes int) {
+	if a == nil || a.metrics == nil {
+		return
+	}
+
+	event := MetricsEvent{
+		Type:           typ,
+		SessionID:      a.connSessionID,
+		DownstreamUser: a.downstreamUser,
+		UpstreamUser:   a.upstreamUser,
+		RemoteAddr:     a.remoteAddr,
+		Direction:      direction,
+		Bytes:          bytes,
+	}
+
+	if ch != nil {
+		event.ChannelType = ch.chanType
+	}
+
+	a.metrics(event)
+}
+
+// filterFromDownstream inspects a packet read from the downstream
+// transport, auditing and gating it against policy before it is
+// forwarded to upstream. A non-nil reply means the packet was denied:
+// reply should be written back to downstream in its place and the
+// original packet must not be forwarded. forward is the (possibly
+// rewritten, e.g. RewriteExec) packet to forward otherwise.
+func (a *channelAuditor) filterFromDownstream(p []byte) (forward, reply []byte, err error) {
+	if a == nil || len(p) == 0 {
+		return p, nil, nil
+	}
+
+	switch p[0] {
+	case msgChannelOpen:
+		return a.handleOpen(p)
+	case msgChannelOpenConfirm:
+		a.handleOpenConfirmFromDownstream(p)
+	case msgChannelRequest:
+		return a.handleRequest(p, true)
+	case msgChannelData:
+		a.handleData(p, true, false)
+	case msgChannelExtendedData:
+		a.handleData(p, true, true)
+	case msgChannelEOF:
+		a.handleEOF(p, true)
+	case msgChannelClose:
+		a.handleClose(p, true)
+	}
+
+	return p, nil, nil
+}
+
+// filterFromUpstream inspects a packet read from the upstream transport
+// before it is forwarded to downstream. Upstream is trusted, so this
+// only audits and records; it never denies.
+func (a *channelAuditor) filterFromUpstream(p []byte) (forward, reply []byte, err error) {
+	if a == nil || len(p) == 0 {
+		return p, nil, nil
+	}
+
+	switch p[0] {
+	case msgChannelOpen:
+		a.handleOpenFromUpstream(p)
+	case msgChannelOpenConfirm:
+		a.handleOpenConfirm(p)
+	case msgChannelOpenFailure:
+		a.handleOpenFailure(p)
+	case msgChannelRequest:
+		return a.handleRequest(p, false)
+	case msgChannelData:
+		a.handleData(p, false, false)
+	case msgChannelExtendedData:
+		a.handleData(p, false, true)
+	case msgChannelEOF:
+		a.handleEOF(p, false)
+	case msgChannelClose:
+		a.handleClose(p, false)
+	}
+
+	return p, nil, nil
+}
+
+// handleOpen audits a channel-open request from downstream and enforces
+// policy.AllowSession / AllowDirectTCPIP on it. A denied channel never
+// reaches upstream: reply carries the SSH_MSG_CHANNEL_OPEN_FAILURE piper
+// sends back to downstream in its place.
+func (a *channelAuditor) handleOpen(p []byte) (forward, reply []byte, err error) {
+	var msg channelOpenMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return p, nil, nil
+	}
+
+	if denied := a.deniedOpen(msg); denied != "" {
+		return nil, Marshal(&channelOpenFailureMsg{
+			PeersID:  msg.PeersID,
+			Reason:   channelProhibited,
+			Message:  denied,
+			Language: "en",
+		}), nil
+	}
+
+	id := atomic.AddUint64(&a.seq, 1)
+
+	ch := &auditedChannel{
+		sessionID: fmt.Sprintf("%s-%d", a.remoteAddr, id),
+		chanType:  msg.ChanType,
+		downID:    msg.PeersID,
+	}
+
+	a.mu.Lock()
+	a.byDown[msg.PeersID] = ch
+	a.mu.Unlock()
+
+	return p, nil, nil
+}
+
+// deniedOpen returns a human-readable denial reason if policy rejects
+// msg, or "" if the channel open is allowed.
+func (a *channelAuditor) deniedOpen(msg channelOpenMsg) string {
+	switch msg.ChanType {
+	case "session":
+		if !a.policy.AllowSession(a.conn) {
+			return "session channels are not permitted on this route"
+		}
+	case "direct-tcpip":
+		destHost, destPort, originHost, originPort, ok := parseDirectTCPIP(msg.TypeSpecificData)
+		if !ok {
+			return "malformed direct-tcpip request"
+		}
+		if !a.policy.AllowDirectTCPIP(a.conn, originHost, originPort, destHost, destPort) {
+			return fmt.Sprintf("port forwarding to %s:%d is not permitted", destHost, destPort)
+		}
+	}
+
+	return ""
+}
+
+// parseDirectTCPIP decodes the type-specific data of a "direct-tcpip"
+// channel-open message (RFC 4254 section 7.2).
+func parseDirectTCPIP(data []byte) (destHost string, destPort uint32, originHost string, originPort uint32, ok bool) {
+	destBytes, rest, valid := parseString(data)
+	if !valid || len(rest) < 4 {
+		return "", 0, "", 0, false
+	}
+	destHost = string(destBytes)
+	destPort = binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	originBytes, rest, valid := parseString(rest)
+	if !valid || len(rest) < 4 {
+		return "", 0, "", 0, false
+	}
+	originHost = string(originBytes)
+	originPort = binary.BigEndian.Uint32(rest)
+
+	return destHost, destPort, originHost, originPort, true
+}
+
+func (a *channelAuditor) handleOpenConfirm(p []byte) {
+	var msg channelOpenConfirmMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	ch, ok := a.byDown[msg.PeersID]
+	if ok {
+		ch.upID = msg.MyID
+		ch.confirmed = true
+		a.byUp[msg.MyID] = ch
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if ch.chanType == "session" && a.recorder != nil {
+		if err := a.recorder.Open(ch.sessionID, 0, 0); err == nil {
+			ch.recording = true
+		}
+	}
+
+	a.emit(AuditChannelOpen, ch, "", "", nil)
+	a.emitMetrics(MetricsChannelOpen, ch, "", 0)
+}
+
+// handleOpenFailure evicts the pending auditedChannel handleOpen added
+// to a.byDown when upstream rejects a channel open that passed local
+// policy (e.g. its own sshd denies a forward). Without this, a channel
+// that never actually opened also never gets a close, and byDown would
+// grow without bound over a long-lived connection that repeatedly
+// attempts denied channels.
+func (a *channelAuditor) handleOpenFailure(p []byte) {
+	var msg channelOpenFailureMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	delete(a.byDown, msg.PeersID)
+	a.mu.Unlock()
+}
+
+// handleOpenFromUpstream audits a channel-open request initiated by
+// upstream, e.g. a "forwarded-tcpip" channel for a remote port forward.
+// Upstream is trusted, so unlike handleOpen this never denies; it
+// registers the channel so it is visible once downstream confirms it,
+// instead of being invisible to the audit log for the life of the
+// channel.
+func (a *channelAuditor) handleOpenFromUpstream(p []byte) {
+	var msg channelOpenMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	id := atomic.AddUint64(&a.seq, 1)
+
+	ch := &auditedChannel{
+		sessionID: fmt.Sprintf("%s-%d", a.remoteAddr, id),
+		chanType:  msg.ChanType,
+		upID:      msg.PeersID,
+	}
+
+	a.mu.Lock()
+	a.byUp[msg.PeersID] = ch
+	a.mu.Unlock()
+}
+
+// handleOpenConfirmFromDownstream completes the bookkeeping for a
+// channel handleOpenFromUpstream registered, once downstream confirms
+// the open and assigns it its own channel number.
+func (a *channelAuditor) handleOpenConfirmFromDownstream(p []byte) {
+	var msg channelOpenConfirmMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	ch, ok := a.byUp[msg.PeersID]
+	if ok {
+		ch.downID = msg.MyID
+		ch.confirmed = true
+		a.byDown[msg.MyID] = ch
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	a.emit(AuditChannelOpen, ch, "", "", nil)
+	a.emitMetrics(MetricsChannelOpen, ch, "", 0)
+}
+
+// handleEOF audits a SSH_MSG_CHANNEL_EOF, sent by either side once it has
+// no more data to send on a channel.
+func (a *channelAuditor) handleEOF(p []byte, fromDownstream bool) {
+	var msg channelEOFMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	ch := a.lookup(msg.PeersID, fromDownstream)
+	if ch == nil {
+		return
+	}
+
+	a.emit(AuditChannelEOF, ch, "", "", nil)
+}
+
+func (a *channelAuditor) lookup(peersID uint32, fromDownstream bool) *auditedChannel {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if fromDownstream {
+		return a.byUp[peersID]
+	}
+	return a.byDown[peersID]
+}
+
+// handleRequest audits a channel request and, for requests originating
+// from downstream, enforces policy.AllowX11 / AllowAgentForwarding /
+// RewriteExec on it. A denied request is answered with
+// SSH_MSG_CHANNEL_FAILURE (if it asked for a reply) instead of being
+// forwarded upstream; RewriteExec may rewrite the forwarded packet.
+func (a *channelAuditor) handleRequest(p []byte, fromDownstream bool) (forward, reply []byte, err error) {
+	var msg channelRequestMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return p, nil, nil
+	}
+
+	ch := a.lookup(msg.PeersID, fromDownstream)
+	if ch == nil {
+		if fromDownstream {
+			// The channel this request addresses hasn't been confirmed by
+			// upstream yet (or never existed): there is nothing to audit
+			// it against or gate it with RewriteExec/AllowX11/
+			// AllowAgentForwarding, and forwarding it anyway would let a
+			// client that doesn't wait for CHANNEL_OPEN_CONFIRMATION
+			// before sending requests bypass ChannelPolicy and the audit
+			// log entirely. Deny it; a compliant client always waits for
+			// the confirmation first and will simply retry then. No
+			// downstream channel number is known here, so the reply
+			// echoes the number the request addressed.
+			return nil, denyChannelRequest(msg, msg.PeersID), nil
+		}
+		return p, nil, nil
+	}
+
+	var command string
+	var exitStatus *uint32
+
+	switch msg.Request {
+	case "exec":
+		if cmd, _, ok := parseString(msg.RequestSpecificData); ok {
+			command = string(cmd)
+		}
+
+		if fromDownstream {
+			rewritten, ok := a.policy.RewriteExec(a.conn, command)
+			if !ok {
+				return nil, denyChannelRequest(msg, ch.downID), nil
+			}
+
+			if rewritten != command {
+				command = rewritten
+
+				data := make([]byte, stringLength(len(rewritten)))
+				marshalString(data, []byte(rewritten))
+				msg.RequestSpecificData = data
+				p = Marshal(&msg)
+			}
+		}
+	case "subsystem":
+		if name, _, ok := parseString(msg.RequestSpecificData); ok {
+			command = name
+		}
+	case "pty-req", "window-change":
+		if width, height, ok := parsePtySize(msg.Request, msg.RequestSpecificData); ok && ch.recording {
+			a.recorder.WindowChange(ch.sessionID, width, height)
+		}
+	case "x11-req":
+		if fromDownstream && !a.policy.AllowX11(a.conn) {
+			return nil, denyChannelRequest(msg, ch.downID), nil
+		}
+	case "auth-agent-req@openssh.com":
+		if fromDownstream && !a.policy.AllowAgentForwarding(a.conn) {
+			return nil, denyChannelRequest(msg, ch.downID), nil
+		}
+	case "exit-status":
+		if len(msg.RequestSpecificData) >= 4 {
+			status := binary.BigEndian.Uint32(msg.RequestSpecificData)
+			exitStatus = &status
+		}
+	}
+
+	a.emit(AuditChannelRequest, ch, msg.Request, command, exitStatus)
+
+	return p, nil, nil
+}
+
+// denyChannelRequest answers a channel request policy rejected. If the
+// sender did not ask for a reply there is nothing useful to send back;
+// the request is still dropped rather than forwarded. recipient is the
+// channel number the reply is addressed to on the downstream side.
+func denyChannelRequest(msg channelRequestMsg, recipient uint32) []byte {
+	if !msg.WantReply {
+		return nil
+	}
+
+	return Marshal(&channelRequestFailureMsg{PeersID: recipient})
+}
+
+// parsePtySize extracts the terminal width/height out of a pty-req or
+// window-change request's type-specific data.
+func parsePtySize(request string, data []byte) (width, height uint32, ok bool) {
+	if request == "pty-req" {
+		_, rest, valid := parseString(data)
+		if !valid || len(rest) < 16 {
+			return 0, 0, false
+		}
+		data = rest
+	}
+
+	if len(data) < 8 {
+		return 0, 0, false
+	}
+
+	width = binary.BigEndian.Uint32(data[0:4])
+	height = binary.BigEndian.Uint32(data[4:8])
+	return width, height, true
+}
+
+func (a *channelAuditor) handleData(p []byte, fromDownstream, extended bool) {
+	ch, payload := a.lookupData(p, fromDownstream, extended)
+	if ch == nil {
+		return
+	}
+
+	direction := "upstream"
+	if fromDownstream {
+		direction = "downstream"
+	}
+	a.emitMetrics(MetricsBytesTransferred, ch, direction, len(payload))
+
+	if !ch.recording {
+		return
+	}
+
+	// Writes from upstream are the session's stdout/stderr; writes from
+	// downstream are keystrokes and are not recorded.
+	if fromDownstream {
+		return
+	}
+
+	a.recorder.Write(ch.sessionID, extended, payload)
+}
+
+func (a *channelAuditor) lookupData(p []byte, fromDownstream, extended bool) (*auditedChannel, []byte) {
+	if extended {
+		var msg channelExtendedDataMsg
+		if err := Unmarshal(p, &msg); err != nil {
+			return nil, nil
+		}
+		return a.lookup(msg.PeersID, fromDownstream), msg.Rest
+	}
+
+	var msg channelDataMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return nil, nil
+	}
+	return a.lookup(msg.PeersID, fromDownstream), msg.Rest
+}
+
+func (a *channelAuditor) handleClose(p []byte, fromDownstream bool) {
+	var msg channelCloseMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	ch := a.lookup(msg.PeersID, fromDownstream)
+	if ch == nil {
+		return
+	}
+
+	a.mu.Lock()
+	delete(a.byDown, ch.downID)
+	delete(a.byUp, ch.upID)
+	a.mu.Unlock()
+
+	if ch.recording {
+		a.recorder.Close(ch.sessionID)
+	}
+
+	a.emit(AuditChannelClose, ch, "", "", nil)
+	a.emitMetrics(MetricsChannelClose, ch, "", 0)
+}
+
+// closeAll flushes the recorder for, and reports MetricsChannelClose for,
+// any channel that was still open when the piped connection tore down.
+func (a *channelAuditor) closeAll() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	chans := make([]*auditedChannel, 0, len(a.byUp))
+	for _, ch := range a.byUp {
+		chans = append(chans, ch)
+	}
+	a.byDown = map[uint32]*auditedChannel{}
+	a.byUp = map[uint32]*auditedChannel{}
+	a.mu.Unlock()
+
+	for _, ch := range chans {
+		if ch.recording {
+			a.recorder.Close(ch.sessionID)
+		}
+		if ch.confirmed {
+			a.emitMetrics(MetricsChannelClose, ch, "", 0)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import "testing"
+
+func newTestAuditor() *channelAuditor {
+	return newChannelAuditor(nil, nil, nil, nil, "sess", nil, "down", "up", nil)
+}
+
+// TestChannelAuditorEvictsPendingOnOpenFailure guards against byDown
+// growing without bound: a channel that passed local policy but was
+// then rejected by upstream never gets a close, so handleOpenFailure
+// must remove the pending entry handleOpen added.
+func TestChannelAuditorEvictsPendingOnOpenFailure(t *testing.T) {
+	a := newTestAuditor()
+
+	open := Marshal(&channelOpenMsg{ChanType: "session", PeersID: 3})
+	if _, _, err := a.filterFromDownstream(open); err != nil {
+		t.Fatalf("filterFromDownstream(open): %v", err)
+	}
+
+	if len(a.byDown) != 1 {
+		t.Fatalf("got %d pending channels after open, want 1", len(a.byDown))
+	}
+
+	failure := Marshal(&channelOpenFailureMsg{PeersID: 3, Reason: channelProhibited, Language: "en"})
+	if _, _, err := a.filterFromUpstream(failure); err != nil {
+		t.Fatalf("filterFromUpstream(failure): %v", err)
+	}
+
+	if len(a.byDown) != 0 {
+		t.Fatalf("got %d pending channels after open failure, want 0", len(a.byDown))
+	}
+}
+
+// TestChannelAuditorTracksUpstreamInitiatedOpen guards against a
+// forwarded-tcpip channel, opened by upstream rather than downstream,
+// being invisible to the audit log for the life of the channel.
+func TestChannelAuditorTracksUpstreamInitiatedOpen(t *testing.T) {
+	a := newTestAuditor()
+
+	open := Marshal(&channelOpenMsg{ChanType: "forwarded-tcpip", PeersID: 9})
+	if _, _, err := a.filterFromUpstream(open); err != nil {
+		t.Fatalf("filterFromUpstream(open): %v", err)
+	}
+
+	if len(a.byUp) != 1 {
+		t.Fatalf("got %d channels in byUp after upstream open, want 1", len(a.byUp))
+	}
+
+	confirm := Marshal(&channelOpenConfirmMsg{PeersID: 9, MyID: 4})
+	if _, _, err := a.filterFromDownstream(confirm); err != nil {
+		t.Fatalf("filterFromDownstream(confirm): %v", err)
+	}
+
+	ch, ok := a.byDown[4]
+	if !ok {
+		t.Fatal("channel not registered in byDown after downstream confirm")
+	}
+	if ch.chanType != "forwarded-tcpip" {
+		t.Fatalf("got chanType %q, want forwarded-tcpip", ch.chanType)
+	}
+
+	eof := Marshal(&channelEOFMsg{PeersID: 9})
+	if _, _, err := a.filterFromDownstream(eof); err != nil {
+		t.Fatalf("filterFromDownstream(eof): %v", err)
+	}
+}
+
+// TestChannelAuditorDeniesRequestForUnconfirmedChannel guards against a
+// downstream client that pipelines CHANNEL_REQUEST right after
+// CHANNEL_OPEN, before upstream's CHANNEL_OPEN_CONFIRMATION round-trips
+// back: with no entry in byUp yet, the request must be denied rather
+// than forwarded unchecked, since forwarding it would bypass
+// ChannelPolicy and the audit log entirely.
+func TestChannelAuditorDeniesRequestForUnconfirmedChannel(t *testing.T) {
+	a := newTestAuditor()
+
+	req := Marshal(&channelRequestMsg{PeersID: 0, Request: "exec", WantReply: true})
+	forward, reply, err := a.filterFromDownstream(req)
+	if err != nil {
+		t.Fatalf("filterFromDownstream(req): %v", err)
+	}
+
+	if forward != nil {
+		t.Fatal("expected the request not to be forwarded to upstream")
+	}
+
+	if reply == nil {
+		t.Fatal("expected a channel-request-failure reply to downstream")
+	}
+}
+
+// TestChannelAuditorAllowsRequestForConfirmedChannel is the control
+// case for TestChannelAuditorDeniesRequestForUnconfirmedChannel: once
+// upstream's confirmation has registered the channel in byUp, a
+// downstream request for it is audited and forwarded as before.
+func TestChannelAuditorAllowsRequestForConfirmedChannel(t *testing.T) {
+	a := newTestAuditor()
+
+	open := Marshal(&channelOpenMsg{ChanType: "session", PeersID: 3})
+	if _, _, err := a.filterFromDownstream(open); err != nil {
+		t.Fatalf("filterFromDownstream(open): %v", err)
+	}
+
+	confirm := Marshal(&channelOpenConfirmMsg{PeersID: 3, MyID: 5})
+	if _, _, err := a.filterFromUpstream(confirm); err != nil {
+		t.Fatalf("filterFromUpstream(confirm): %v", err)
+	}
+
+	req := Marshal(&channelRequestMsg{PeersID: 5, Request: "shell", WantReply: true})
+	forward, _, err := a.filterFromDownstream(req)
+	if err != nil {
+		t.Fatalf("filterFromDownstream(req): %v", err)
+	}
+
+	if forward == nil {
+		t.Fatal("expected the request to be forwarded to upstream")
+	}
+}
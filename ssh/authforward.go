@@ -0,0 +1,185 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PipeAuthMethod names an ssh auth method sshpiper can offer downstream
+// or present upstream, for routes that translate between the two (the
+// "credential broker" pattern: e.g. accept publickey downstream but
+// authenticate password upstream using a vaulted secret).
+type PipeAuthMethod string
+
+// The auth methods SSHPiper knows how to translate.
+const (
+	PipeAuthMethodPublicKey           PipeAuthMethod = "publickey"
+	PipeAuthMethodPassword            PipeAuthMethod = "password"
+	PipeAuthMethodKeyboardInteractive PipeAuthMethod = "keyboard-interactive"
+)
+
+// ExtraAuth describes an additional auth step sshpiper should present to
+// upstream after MapPublicKey's primary method succeeds with partial
+// success, letting a pubkey-authenticated downstream still drive the
+// upstream's other required methods.
+type ExtraAuth struct {
+	Method   PipeAuthMethod
+	Password []byte
+}
+
+// buildRequest renders e as the userAuthRequestMsg sshpiper sends
+// directly to upstream, bypassing downstream.
+func (e ExtraAuth) buildRequest(user string) (*userAuthRequestMsg, error) {
+	switch e.Method {
+	case PipeAuthMethodPassword:
+		return &userAuthRequestMsg{
+			User:    user,
+			Service: serviceSSH,
+			Method:  string(PipeAuthMethodPassword),
+			Payload: marshalPasswordPayload(e.Password, false),
+		}, nil
+	default:
+		return nil, fmt.Errorf("ssh: unsupported extra auth method %q", e.Method)
+	}
+}
+
+// parsePasswordMsg extracts the password (and change-password flag) from
+// a "password" auth userAuthRequestMsg, per RFC 4252 section 8.
+func parsePasswordMsg(msg *userAuthRequestMsg) (password []byte, isChange bool, err error) {
+	payload := msg.Payload
+	if len(payload) < 1 {
+		return nil, false, parseError(msgUserAuthRequest)
+	}
+
+	isChange = payload[0] != 0
+	payload = payload[1:]
+
+	password, _, ok := parseString(payload)
+	if !ok {
+		return nil, false, parseError(msgUserAuthRequest)
+	}
+
+	return password, isChange, nil
+}
+
+// marshalPasswordPayload renders the type-specific payload of a
+// "password" auth userAuthRequestMsg.
+func marshalPasswordPayload(password []byte, isChange bool) []byte {
+	payload := make([]byte, 1+4+len(password))
+	if isChange {
+		payload[0] = 1
+	}
+
+	binary.BigEndian.PutUint32(payload[1:5], uint32(len(password)))
+	copy(payload[5:], password)
+
+	return payload
+}
+
+// parseInfoRequestMsg decodes a SSH_MSG_USERAUTH_INFO_REQUEST packet
+// (RFC 4256 section 3.2): name, instruction, a (deprecated, ignored)
+// language tag, then a list of prompt/echo pairs.
+func parseInfoRequestMsg(packet []byte) (name, instruction string, prompts []string, echos []bool, err error) {
+	if len(packet) < 1 {
+		return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+	}
+
+	rest := packet[1:]
+
+	nameBytes, rest, ok := parseString(rest)
+	if !ok {
+		return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+	}
+	name = string(nameBytes)
+
+	instBytes, rest, ok := parseString(rest)
+	if !ok {
+		return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+	}
+	instruction = string(instBytes)
+
+	// deprecated language tag
+	_, rest, ok = parseString(rest)
+	if !ok {
+		return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+	}
+
+	if len(rest) < 4 {
+		return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+	}
+	num := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	for i := uint32(0); i < num; i++ {
+		var promptBytes []byte
+
+		promptBytes, rest, ok = parseString(rest)
+		if !ok || len(rest) < 1 {
+			return "", "", nil, nil, parseError(msgUserAuthInfoRequest)
+		}
+
+		prompts = append(prompts, string(promptBytes))
+		echos = append(echos, rest[0] != 0)
+		rest = rest[1:]
+	}
+
+	return name, instruction, prompts, echos, nil
+}
+
+// parseInfoResponseMsg decodes a SSH_MSG_USERAUTH_INFO_RESPONSE packet
+// (RFC 4256 section 3.4): a count followed by that many answer strings.
+func parseInfoResponseMsg(packet []byte) ([]string, error) {
+	if len(packet) < 1 {
+		return nil, parseError(msgUserAuthInfoResponse)
+	}
+
+	rest := packet[1:]
+	if len(rest) < 4 {
+		return nil, parseError(msgUserAuthInfoResponse)
+	}
+
+	num := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	var answers []string
+	for i := uint32(0); i < num; i++ {
+		var answerBytes []byte
+
+		var ok bool
+		answerBytes, rest, ok = parseString(rest)
+		if !ok {
+			return nil, parseError(msgUserAuthInfoResponse)
+		}
+
+		answers = append(answers, string(answerBytes))
+	}
+
+	return answers, nil
+}
+
+// marshalInfoResponseMsg renders a SSH_MSG_USERAUTH_INFO_RESPONSE packet
+// carrying answers, in the same order as the prompts they answer.
+func marshalInfoResponseMsg(answers []string) []byte {
+	length := 1 + 4
+	for _, a := range answers {
+		length += 4 + len(a)
+	}
+
+	data := make([]byte, length)
+	data[0] = msgUserAuthInfoResponse
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(answers)))
+
+	rest := data[5:]
+	for _, a := range answers {
+		binary.BigEndian.PutUint32(rest, uint32(len(a)))
+		copy(rest[4:], a)
+		rest = rest[4+len(a):]
+	}
+
+	return data
+}
@@ -0,0 +1,111 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInfoResponseMsgRoundTrip(t *testing.T) {
+	want := []string{"hunter2", "42"}
+
+	got, err := parseInfoResponseMsg(marshalInfoResponseMsg(want))
+	if err != nil {
+		t.Fatalf("parseInfoResponseMsg: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestParseInfoResponseMsgHugeCountDoesNotAllocate guards against
+// trusting the wire-supplied answer count for capacity: a packet
+// claiming billions of answers but carrying none of the bytes to back
+// that count must fail fast with a parse error, not attempt a multi-GB
+// allocation.
+func TestParseInfoResponseMsgHugeCountDoesNotAllocate(t *testing.T) {
+	packet := make([]byte, 5)
+	packet[0] = msgUserAuthInfoResponse
+	binary.BigEndian.PutUint32(packet[1:], 0xFFFFFFF0)
+
+	if _, err := parseInfoResponseMsg(packet); err == nil {
+		t.Fatal("expected a parse error for an unbacked answer count, got nil")
+	}
+}
+
+func TestParseInfoResponseMsgTruncated(t *testing.T) {
+	full := marshalInfoResponseMsg([]string{"only-answer"})
+
+	if _, err := parseInfoResponseMsg(full[:len(full)-2]); err == nil {
+		t.Fatal("expected a parse error for a truncated packet, got nil")
+	}
+}
+
+// TestPasswordAuthMsgError guards the MapPassword error path: it must
+// degrade to a none-auth message for the original user, the same as
+// MapPublicKey, rather than the caller killing the connection.
+func TestPasswordAuthMsgError(t *testing.T) {
+	msg := &userAuthRequestMsg{
+		User:    "alice",
+		Service: serviceSSH,
+		Method:  "password",
+		Payload: marshalPasswordPayload([]byte("hunter2"), false),
+	}
+
+	got := passwordAuthMsg(msg, "mapped-alice", nil, false, errors.New("vault timeout"))
+
+	want := noneAuthMsg("alice")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPasswordAuthMsgSuccess(t *testing.T) {
+	msg := &userAuthRequestMsg{
+		User:    "alice",
+		Service: serviceSSH,
+		Method:  "password",
+	}
+
+	got := passwordAuthMsg(msg, "mapped-alice", []byte("s3cret"), true, nil)
+
+	if got.User != "mapped-alice" {
+		t.Fatalf("got user %q, want %q", got.User, "mapped-alice")
+	}
+
+	if !reflect.DeepEqual(got.Payload, marshalPasswordPayload([]byte("s3cret"), true)) {
+		t.Fatal("payload does not match the mapped password")
+	}
+}
+
+// TestKeyboardInteractiveAnswersError guards the MapKeyboardInteractive
+// error path: it must send one empty answer per prompt, so upstream's
+// own auth failure propagates naturally instead of the caller killing
+// the connection.
+func TestKeyboardInteractiveAnswersError(t *testing.T) {
+	prompts := []string{"Password: ", "Token: "}
+
+	got := keyboardInteractiveAnswers(prompts, []string{"leaked", "leaked"}, errors.New("vault timeout"))
+
+	want := []string{"", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestKeyboardInteractiveAnswersSuccess(t *testing.T) {
+	mapped := []string{"s3cret"}
+
+	got := keyboardInteractiveAnswers([]string{"Password: "}, mapped, nil)
+
+	if !reflect.DeepEqual(got, mapped) {
+		t.Fatalf("got %v, want %v", got, mapped)
+	}
+}
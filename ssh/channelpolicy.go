@@ -0,0 +1,64 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+// channelProhibited is the SSH_OPEN_ADMINISTRATIVELY_PROHIBITED open
+// failure reason code (RFC 4254 section 5.1), sent back to downstream
+// when a ChannelPolicy denies a channel.
+const channelProhibited = 1
+
+// ChannelPolicy governs what a piped connection's channels are allowed
+// to do once auth has succeeded. The default, ForwardAllPolicy, forwards
+// everything, preserving the historical behaviour of a plain byte pipe;
+// operators can supply their own ChannelPolicy via
+// SSHPiperConfig.ChannelPolicy to deny port-forwarding, restrict exec to
+// an allowlist, or rewrite commands.
+type ChannelPolicy interface {
+	// AllowSession reports whether conn may open a "session" channel at
+	// all (the channel type shell/exec/subsystem/pty-req run over).
+	AllowSession(conn ConnMetadata) bool
+
+	// AllowDirectTCPIP reports whether conn may open a "direct-tcpip"
+	// channel (local port-forwarding, -L) from originHost:originPort to
+	// destHost:destPort.
+	AllowDirectTCPIP(conn ConnMetadata, originHost string, originPort uint32, destHost string, destPort uint32) bool
+
+	// AllowX11 reports whether conn may request X11 forwarding via an
+	// "x11-req" channel request.
+	AllowX11(conn ConnMetadata) bool
+
+	// AllowAgentForwarding reports whether conn may request ssh-agent
+	// forwarding via an "auth-agent-req@openssh.com" channel request.
+	AllowAgentForwarding(conn ConnMetadata) bool
+
+	// RewriteExec is consulted for every "exec" channel request. It
+	// returns the command that should actually be forwarded upstream
+	// (unchanged, to leave it as-is) and ok=false to deny the request
+	// entirely.
+	RewriteExec(conn ConnMetadata, cmd string) (rewritten string, ok bool)
+}
+
+// ForwardAllPolicy is the default ChannelPolicy: it allows every channel
+// and request and never rewrites a command, preserving the behaviour of
+// a plain byte-for-byte pipe.
+type ForwardAllPolicy struct{}
+
+// AllowSession implements ChannelPolicy.
+func (ForwardAllPolicy) AllowSession(conn ConnMetadata) bool { return true }
+
+// AllowDirectTCPIP implements ChannelPolicy.
+func (ForwardAllPolicy) AllowDirectTCPIP(conn ConnMetadata, originHost string, originPort uint32, destHost string, destPort uint32) bool {
+	return true
+}
+
+// AllowX11 implements ChannelPolicy.
+func (ForwardAllPolicy) AllowX11(conn ConnMetadata) bool { return true }
+
+// AllowAgentForwarding implements ChannelPolicy.
+func (ForwardAllPolicy) AllowAgentForwarding(conn ConnMetadata) bool { return true }
+
+// RewriteExec implements ChannelPolicy.
+func (ForwardAllPolicy) RewriteExec(conn ConnMetadata, cmd string) (string, bool) { return cmd, true }
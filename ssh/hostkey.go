@@ -0,0 +1,267 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// hostKeyCallbackFor picks the HostKeyCallback sshpiper should enforce
+// against the upstream for this connection: per-route known_hosts files
+// supplied by an UpstreamProvider take precedence over the piper-wide
+// HostKeyCallback, which in turn is left nil (trust on connect) if the
+// operator configured neither.
+func (piper *SSHPiperConfig) hostKeyCallbackFor(conn ConnMetadata, auth *UpstreamAuth) (func(hostname string, remote net.Addr, key PublicKey) error, error) {
+	var cb func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error
+
+	if auth != nil && len(auth.KnownHosts) > 0 {
+		known, err := KnownHostsCallback(auth.KnownHosts...)
+		if err != nil {
+			return nil, err
+		}
+		cb = known
+	} else if piper.HostKeyCallback != nil {
+		cb = piper.HostKeyCallback
+	}
+
+	if cb == nil {
+		return nil, nil
+	}
+
+	return func(hostname string, remote net.Addr, key PublicKey) error {
+		return cb(conn, hostname, remote, key)
+	}, nil
+}
+
+// knownHostsEntry is one parsed line of an OpenSSH known_hosts file.
+type knownHostsEntry struct {
+	hostname string // literal, or empty when hashed
+	hash     string // HMAC-SHA1 base64 digest, when hostname is hashed
+	salt     []byte
+
+	cert bool // line carried the @cert-authority marker
+	key  PublicKey
+}
+
+func (e *knownHostsEntry) matches(hostname string) bool {
+	if e.hash != "" {
+		mac := hmac.New(sha1.New, e.salt)
+		mac.Write([]byte(hostname))
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == e.hash
+	}
+
+	for _, h := range strings.Split(e.hostname, ",") {
+		if h == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KnownHostsCallback parses one or more files in OpenSSH known_hosts
+// format (including hashed hostnames and @cert-authority lines) and
+// returns a callback suitable for SSHPiperConfig.HostKeyCallback (wrapped
+// to also receive the downstream ConnMetadata) that rejects any upstream
+// host key not present, or not signed by a certificate authority present,
+// in those files.
+func KnownHostsCallback(paths ...string) (func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error, error) {
+	var entries []knownHostsEntry
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			entry, err := parseKnownHostsLine(line)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("known_hosts %v: %v", path, err)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error {
+		host := hostnameForMatch(hostname, remote)
+		marshaled := key.Marshal()
+
+		for _, e := range entries {
+			if !e.matches(host) {
+				continue
+			}
+
+			if e.cert {
+				if cert, ok := key.(*Certificate); ok && bytes.Equal(cert.SignatureKey.Marshal(), e.key.Marshal()) {
+					return nil
+				}
+				continue
+			}
+
+			if bytes.Equal(e.key.Marshal(), marshaled) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("ssh: no known_hosts entry for %v", host)
+	}, nil
+}
+
+// hostnameForMatch renders the upstream address the way known_hosts
+// names it: a bare host for port 22, "[host]:port" for any other port.
+func hostnameForMatch(hostname string, remote net.Addr) string {
+	if hostname == "" {
+		hostname = remote.String()
+	}
+
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return hostname
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+func parseKnownHostsLine(line string) (knownHostsEntry, error) {
+	var entry knownHostsEntry
+
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "@cert-authority" {
+		entry.cert = true
+		fields = fields[1:]
+	}
+
+	if len(fields) < 3 {
+		return entry, fmt.Errorf("malformed line %q", line)
+	}
+
+	host, keyType, keyData := fields[0], fields[1], fields[2]
+
+	if strings.HasPrefix(host, "|1|") {
+		parts := strings.Split(host, "|")
+		if len(parts) != 4 {
+			return entry, fmt.Errorf("malformed hashed host %q", host)
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return entry, err
+		}
+
+		entry.salt = salt
+		entry.hash = parts[3]
+	} else {
+		entry.hostname = host
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(keyData)
+	if err != nil {
+		return entry, err
+	}
+
+	key, err := ParsePublicKey(keyBytes)
+	if err != nil {
+		return entry, err
+	}
+
+	if key.Type() != keyType {
+		return entry, fmt.Errorf("key type %q does not match advertised %q", key.Type(), keyType)
+	}
+
+	entry.key = key
+
+	return entry, nil
+}
+
+// KeyStore is the persistence backend for TOFUCallback: it records the
+// host key pinned for each hostname the first time it is seen.
+type KeyStore interface {
+	Get(hostname string) (PublicKey, bool)
+	Put(hostname string, key PublicKey) error
+}
+
+// memoryKeyStore is a minimal, process-lifetime KeyStore. Deployments
+// that need pins to survive a restart should provide their own KeyStore
+// backed by a file or database.
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// NewMemoryKeyStore returns a KeyStore that keeps pinned keys in memory
+// for the lifetime of the process.
+func NewMemoryKeyStore() KeyStore {
+	return &memoryKeyStore{keys: map[string][]byte{}}
+}
+
+func (s *memoryKeyStore) Get(hostname string) (PublicKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.keys[hostname]
+	if !ok {
+		return nil, false
+	}
+
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, false
+	}
+
+	return key, true
+}
+
+func (s *memoryKeyStore) Put(hostname string, key PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[hostname] = key.Marshal()
+	return nil
+}
+
+// TOFUCallback returns a HostKeyCallback that pins the first host key it
+// sees for a hostname in store, and rejects any later connection
+// presenting a different key for that hostname.
+func TOFUCallback(store KeyStore) func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error {
+	return func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error {
+		host := hostnameForMatch(hostname, remote)
+
+		if pinned, ok := store.Get(host); ok {
+			if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+				return fmt.Errorf("ssh: host key for %v does not match pinned key, possible MITM", host)
+			}
+			return nil
+		}
+
+		return store.Put(host, key)
+	}
+}
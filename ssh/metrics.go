@@ -0,0 +1,110 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+package ssh
+
+import "time"
+
+// MetricsEventType names the kind of observation a MetricsEvent records.
+type MetricsEventType string
+
+// The metrics event types emitted by a piped connection. A MetricsHook
+// sees one of these per instrumented point; see sshpiperd/metrics for a
+// ready-made Prometheus collector built on top of them.
+const (
+	// MetricsConnection fires once NewSSHPiperConn has run to
+	// completion, with Result "success" or "failure".
+	MetricsConnection MetricsEventType = "connection"
+
+	// MetricsConnectionClosed fires when a previously-established piped
+	// connection is torn down.
+	MetricsConnectionClosed MetricsEventType = "connection_closed"
+
+	// MetricsHandshake fires alongside MetricsConnection with the total
+	// time NewSSHPiperConn spent, success or not.
+	MetricsHandshake MetricsEventType = "handshake"
+
+	// MetricsUpstreamDial fires after the ssh handshake with the upstream
+	// server, with Result "success" or "failure". Duration covers the
+	// handshake only; the TCP connection was already dialed by
+	// FindUpstream or the Provider.
+	MetricsUpstreamDial MetricsEventType = "upstream_dial"
+
+	// MetricsAuthAttempt fires once per auth method relayed to upstream,
+	// including ExtraAuth steps, with Method set to the auth method and
+	// Result to "success", "failure" or "continue" (more auth required,
+	// e.g. partial success or a keyboard-interactive round still in
+	// progress). A keyboard-interactive exchange fires once more with its
+	// final Result when upstream stops sending prompts.
+	MetricsAuthAttempt MetricsEventType = "auth_attempt"
+
+	// MetricsChannelOpen fires once a channel open is confirmed by
+	// upstream, with ChannelType set.
+	MetricsChannelOpen MetricsEventType = "channel_open"
+
+	// MetricsChannelClose fires once a channel is closed, with
+	// ChannelType set.
+	MetricsChannelClose MetricsEventType = "channel_close"
+
+	// MetricsBytesTransferred fires for every channel data packet
+	// relayed, with Direction "upstream" (server to client) or
+	// "downstream" (client to server) and Bytes set to the payload size.
+	MetricsBytesTransferred MetricsEventType = "bytes_transferred"
+)
+
+// MetricsEvent is a single point-in-time observation emitted by a piped
+// connection. Fields not meaningful for Type are left zero.
+type MetricsEvent struct {
+	Type MetricsEventType
+
+	SessionID      string
+	DownstreamUser string
+	UpstreamUser   string
+	RemoteAddr     string
+
+	Method      string // MetricsAuthAttempt
+	Result      string // MetricsConnection, MetricsUpstreamDial, MetricsAuthAttempt
+	Direction   string // MetricsBytesTransferred
+	ChannelType string // MetricsChannelOpen, MetricsChannelClose
+	Bytes       int    // MetricsBytesTransferred
+	Duration    time.Duration
+}
+
+// MetricsHook receives a MetricsEvent for every instrumented observation
+// point on a piped connection, for forwarding into a metrics system such
+// as Prometheus.
+type MetricsHook func(event MetricsEvent)
+
+// resultLabel is the "success"/"failure" Result a MetricsEvent reports
+// for a completed operation.
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// authAttemptResult classifies upstream's reply to a forwarded auth
+// packet for MetricsAuthAttempt: "success", "failure", or "continue" for
+// anything else (a keyboard-interactive info-request, partial success
+// followed by another method, and so on).
+func authAttemptResult(packet []byte) string {
+	if len(packet) == 0 {
+		return "continue"
+	}
+
+	switch packet[0] {
+	case msgUserAuthSuccess:
+		return "success"
+	case msgUserAuthFailure:
+		var failure userAuthFailureMsg
+		if err := Unmarshal(packet, &failure); err == nil && failure.PartialSuccess {
+			return "continue"
+		}
+		return "failure"
+	default:
+		return "continue"
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 )
 
 // SSHPiperConfig holds SSHPiper specific configuration data.
@@ -37,8 +38,104 @@ type SSHPiperConfig struct {
 	// If any error occurs during this period, a NoneAuth packet will be sent to
 	// upstream ssh server instead.
 	//
+	// The returned extraAuth, if non-empty, is presented to upstream after
+	// the publickey auth succeeds with partial success, letting a
+	// pubkey-authenticated downstream still drive e.g. a vaulted password
+	// upstream when the target requires more than one auth method.
+	//
 	// More info: https://github.com/tg123/sshpiper#publickey-sign-again
-	MapPublicKey func(conn ConnMetadata, key PublicKey) (Signer, error)
+	MapPublicKey func(conn ConnMetadata, key PublicKey) (signer Signer, extraAuth []ExtraAuth, err error)
+
+	// MapPassword, if non-nil, is called when downstream requests a
+	// password auth. SSHPiper forwards the returned password upstream in
+	// place of the one the downstream client sent; return it unchanged to
+	// forward verbatim. If it returns an error, like MapPublicKey this
+	// fails only the current auth attempt (downstream gets a failure and
+	// may retry with another method) rather than closing the connection.
+	MapPassword func(conn ConnMetadata, password []byte) ([]byte, error)
+
+	// MapKeyboardInteractive, if non-nil, is called for each
+	// keyboard-interactive round trip with upstream, letting SSHPiper
+	// answer the prompts instead of relaying downstream's answers
+	// verbatim. If nil, prompts and answers are forwarded as-is. If it
+	// returns an error, empty answers are sent upstream so its own auth
+	// failure propagates naturally, rather than closing the connection.
+	MapKeyboardInteractive func(conn ConnMetadata, name, instruction string, questions []string, echos []bool) (answers []string, err error)
+
+	// HostKeyCallback, if non-nil, is called during the handshake with the
+	// upstream server to verify its host key. If it returns an error the
+	// piped connection is closed before any auth is forwarded. Use
+	// KnownHostsCallback or TOFUCallback to build one; leaving this nil
+	// preserves the previous behaviour of trusting any upstream host key.
+	HostKeyCallback func(conn ConnMetadata, hostname string, remote net.Addr, key PublicKey) error
+
+	// AuditHook, if non-nil, is called for every channel-level event
+	// (channel open/close, channel requests such as exec/shell/pty-req,
+	// exit-status) observed on the piped connection once auth succeeds.
+	AuditHook func(event AuditEvent)
+
+	// Recorder, if non-nil, receives the stdout/stderr of piped session
+	// channels so it can persist a terminal recording (e.g. asciinema)
+	// alongside the structured audit trail from AuditHook.
+	Recorder Recorder
+
+	// ChannelPolicy governs what the piped connection's channels may do;
+	// see ChannelPolicy. Defaults to ForwardAllPolicy, preserving the
+	// historical behaviour of forwarding everything.
+	ChannelPolicy ChannelPolicy
+
+	// Provider, if non-nil, is consulted instead of FindUpstream to resolve
+	// the upstream for a connection. It is the declarative counterpart to
+	// FindUpstream: a Provider can be backed by a config file, an external
+	// program or a webhook instead of a Go func baked into the binary, and
+	// can be swapped or reloaded at runtime. See package router for the
+	// built-in providers. If both Provider and FindUpstream are set,
+	// Provider takes precedence.
+	Provider UpstreamProvider
+
+	// Metrics, if non-nil, is called for every instrumented observation
+	// point on a piped connection (connect, auth attempts, upstream dial,
+	// channel open/close, bytes relayed); see MetricsEvent. Use
+	// sshpiperd/metrics to collect these into Prometheus.
+	Metrics MetricsHook
+
+	// SignerForRef, if non-nil, resolves the SignerRef an UpstreamProvider
+	// attached to an UpstreamAuth into the Signer sshpiper should sign
+	// upstream publickey auth with, in place of the Signer MapPublicKey
+	// returned. Use package signer's Register/Lookup to back this with
+	// ssh-agent or PKCS#11 signers keyed by name. Has no effect when the
+	// resolved UpstreamAuth has an empty SignerRef, and is consulted only
+	// when MapPublicKey is set and returned a non-nil Signer without error.
+	SignerForRef func(ref string) (Signer, error)
+}
+
+// UpstreamAuth carries authentication material resolved by an
+// UpstreamProvider alongside the upstream address and user.
+type UpstreamAuth struct {
+	// SignerRef names a signer (see MapPublicKey) sshpiper should use when
+	// authenticating to the upstream, resolved into a Signer by
+	// SSHPiperConfig.SignerForRef.
+	SignerRef string
+
+	// KnownHosts lists known_hosts-format files (see KnownHostsCallback)
+	// the upstream host key must match.
+	KnownHosts []string
+}
+
+// signerRef returns a.SignerRef, or "" if a is nil (no UpstreamAuth was
+// resolved, e.g. FindUpstream was used instead of a Provider).
+func (a *UpstreamAuth) signerRef() string {
+	if a == nil {
+		return ""
+	}
+	return a.SignerRef
+}
+
+// UpstreamProvider resolves a downstream connection to an upstream ssh
+// server. It is the pluggable form of SSHPiperConfig.FindUpstream; see
+// SSHPiperConfig.Provider.
+type UpstreamProvider interface {
+	FindUpstream(conn ConnMetadata) (net.Conn, string, *UpstreamAuth, error)
 }
 
 type upstream struct{ *connection }
@@ -48,7 +145,30 @@ type pipedConn struct {
 	upstream   *upstream
 	downstream *downstream
 
+	// upstreamAuth is the UpstreamAuth returned alongside the upstream
+	// connection when SSHPiperConfig.Provider resolved it, or nil when
+	// FindUpstream was used instead.
+	upstreamAuth *UpstreamAuth
+
+	// auditor inspects the piped channel traffic to emit AuditEvents and
+	// feed the Recorder, once auth has succeeded.
+	auditor *channelAuditor
+
+	mappedUser string
+
+	// extraAuth queues ExtraAuth steps returned by MapPublicKey, consumed
+	// by drainExtraAuth as upstream reports partial success.
+	extraAuth []ExtraAuth
+
+	mapKeyboardInteractive func(conn ConnMetadata, name, instruction string, questions []string, echos []bool) ([]string, error)
+
 	processAuthMsg func(msg *userAuthRequestMsg) (*userAuthRequestMsg, error)
+
+	// metrics is piper.Metrics, copied here so Close and pipeAuth can
+	// report without holding onto the whole SSHPiperConfig.
+	metrics MetricsHook
+
+	sessionID string
 }
 
 // SSHPiperConn is a piped SSH connection, linking upstream ssh server and
@@ -88,8 +208,16 @@ func (s *SSHPiperConfig) AddHostKey(key Signer) {
 // It handshake with downstream ssh client and upstream ssh server provicde by FindUpstream.
 // If either handshake is unsuccessful, the whole piped connection will be closed.
 func NewSSHPiperConn(conn net.Conn, piper *SSHPiperConfig) (pipe *SSHPiperConn, err error) {
+	start := time.Now()
 
-	if piper.FindUpstream == nil {
+	if piper.Metrics != nil {
+		defer func() {
+			piper.Metrics(MetricsEvent{Type: MetricsConnection, Result: resultLabel(err)})
+			piper.Metrics(MetricsEvent{Type: MetricsHandshake, Duration: time.Since(start)})
+		}()
+	}
+
+	if piper.FindUpstream == nil && piper.Provider == nil {
 		panic("FindUpstream func not found")
 	}
 
@@ -148,7 +276,15 @@ func NewSSHPiperConn(conn net.Conn, piper *SSHPiperConfig) (pipe *SSHPiperConn,
 		}
 	}
 
-	upconn, mappedUser, err := piper.FindUpstream(d)
+	var upconn net.Conn
+	var mappedUser string
+	var upAuth *UpstreamAuth
+
+	if piper.Provider != nil {
+		upconn, mappedUser, upAuth, err = piper.Provider.FindUpstream(d)
+	} else {
+		upconn, mappedUser, err = piper.FindUpstream(d)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +295,16 @@ func NewSSHPiperConn(conn net.Conn, piper *SSHPiperConfig) (pipe *SSHPiperConn,
 		mappedUser = d.user
 	}
 
-	u, err := newUpstream(upconn, addr, &ClientConfig{})
+	hostKeyCallback, err := piper.hostKeyCallbackFor(d, upAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	dialStart := time.Now()
+	u, err := newUpstream(upconn, addr, &ClientConfig{HostKeyCallback: hostKeyCallback})
+	if piper.Metrics != nil {
+		piper.Metrics(MetricsEvent{Type: MetricsUpstreamDial, Result: resultLabel(err), Duration: time.Since(dialStart)})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -169,13 +314,31 @@ func NewSSHPiperConn(conn net.Conn, piper *SSHPiperConfig) (pipe *SSHPiperConn,
 		}
 	}()
 
+	sessionID := fmt.Sprintf("%x", d.SessionID())
+
 	p := &pipedConn{
-		upstream:   u,
-		downstream: d,
+		upstream:               u,
+		downstream:             d,
+		upstreamAuth:           upAuth,
+		mappedUser:             mappedUser,
+		mapKeyboardInteractive: piper.MapKeyboardInteractive,
+		auditor:                newChannelAuditor(piper.AuditHook, piper.Recorder, piper.ChannelPolicy, piper.Metrics, sessionID, d, d.user, mappedUser, d.RemoteAddr()),
+		metrics:                piper.Metrics,
+		sessionID:              sessionID,
 	}
 
 	p.processAuthMsg = func(msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
 
+		if msg.Method == "password" && piper.MapPassword != nil {
+			password, isChange, err := parsePasswordMsg(msg)
+			if err != nil {
+				return nil, err
+			}
+
+			mapped, err := piper.MapPassword(d, password)
+			return passwordAuthMsg(msg, mappedUser, mapped, isChange, err), nil
+		}
+
 		// only public msg need
 		if msg.Method != "publickey" || piper.MapPublicKey == nil {
 			msg.User = mappedUser
@@ -189,13 +352,23 @@ func NewSSHPiperConn(conn net.Conn, piper *SSHPiperConfig) (pipe *SSHPiperConn,
 			return nil, err
 		}
 
-		signer, err := piper.MapPublicKey(d, downKey)
+		signer, extraAuth, err := piper.MapPublicKey(d, downKey)
 
 		// no mapped user change it to none or error occur
 		if err != nil || signer == nil {
 			return noneAuthMsg(user), nil
 		}
 
+		if ref := p.upstreamAuth.signerRef(); ref != "" && piper.SignerForRef != nil {
+			refSigner, err := piper.SignerForRef(ref)
+			if err != nil || refSigner == nil {
+				return noneAuthMsg(user), nil
+			}
+			signer = refSigner
+		}
+
+		p.extraAuth = extraAuth
+
 		upKey := signer.PublicKey()
 
 		if isQuery {
@@ -273,11 +446,24 @@ func (pipe *pipedConn) signAgain(user string, msg *userAuthRequestMsg, signer Si
 	upKey := signer.PublicKey()
 	upKeyData := upKey.Marshal()
 
-	sign, err := signer.Sign(rand, buildDataSignedForAuth(session, userAuthRequestMsg{
+	// algo may differ from upKey.Type() for signers that only support a
+	// subset of the algorithms their key type allows, e.g. an ssh-agent
+	// holding an RSA key that refuses rsa-sha2-512.
+	algo := negotiateAlgo(signer, upKey)
+
+	signedData := buildDataSignedForAuth(session, userAuthRequestMsg{
 		User:    user,
 		Service: serviceSSH,
 		Method:  "publickey",
-	}, []byte(upKey.Type()), upKeyData))
+	}, []byte(algo), upKeyData)
+
+	var sign *Signature
+	var err error
+	if as, ok := signer.(AlgoSigner); ok {
+		sign, err = as.SignWithAlgo(rand, signedData, algo)
+	} else {
+		sign, err = signer.Sign(rand, signedData)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -292,7 +478,7 @@ func (pipe *pipedConn) signAgain(user string, msg *userAuthRequestMsg, signer Si
 		Service:  serviceSSH,
 		Method:   "publickey",
 		HasSig:   true,
-		Algoname: upKey.Type(),
+		Algoname: algo,
 		PubKey:   upKeyData,
 		Sig:      sig,
 	}
@@ -343,19 +529,45 @@ func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signa
 	return pubKey, isQuery, sig, nil
 }
 
-func piping(dst, src packetConn) error {
+// piping is a channel-aware proxy loop: it reads packets from src and
+// hands each to filter before forwarding it to dst, letting filter
+// observe channel-level traffic (for auditing/recording) and gate it
+// against a ChannelPolicy. Packets stream through one SSH_MSG at a time,
+// so a large CHANNEL_DATA payload is never buffered beyond its own
+// packet. filter returns:
+//   - forward non-nil: write forward (the original packet, or a
+//     rewritten one, e.g. RewriteExec) to dst.
+//   - reply non-nil: the packet was denied; write reply back to src
+//     instead of forwarding anything to dst.
+//   - both nil: the packet was denied and there is nothing useful to
+//     reply with; it is dropped silently.
+func piping(dst, src packetConn, filter func(p []byte) (forward, reply []byte, err error)) error {
 	for {
 		p, err := src.readPacket()
 
 		if err != nil {
 			return err
 		}
-		fmt.Println(string(p))
-		err = dst.writePacket(p)
 
+		forward, reply, err := filter(p)
 		if err != nil {
 			return err
 		}
+
+		if reply != nil {
+			if err := src.writePacket(reply); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if forward == nil {
+			continue
+		}
+
+		if err := dst.writePacket(forward); err != nil {
+			return err
+		}
 	}
 }
 
@@ -363,11 +575,11 @@ func (pipe *pipedConn) loop() error {
 	c := make(chan error)
 
 	go func() {
-		c <- piping(pipe.upstream.transport, pipe.downstream.transport)
+		c <- piping(pipe.upstream.transport, pipe.downstream.transport, pipe.auditor.filterFromDownstream)
 	}()
 
 	go func() {
-		c <- piping(pipe.downstream.transport, pipe.upstream.transport)
+		c <- piping(pipe.downstream.transport, pipe.upstream.transport, pipe.auditor.filterFromUpstream)
 	}()
 
 	defer pipe.Close()
@@ -379,6 +591,11 @@ func (pipe *pipedConn) loop() error {
 func (pipe *pipedConn) Close() {
 	pipe.upstream.transport.Close()
 	pipe.downstream.transport.Close()
+	pipe.auditor.closeAll()
+
+	if pipe.metrics != nil {
+		pipe.metrics(MetricsEvent{Type: MetricsConnectionClosed, SessionID: pipe.sessionID})
+	}
 }
 
 func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
@@ -399,6 +616,8 @@ func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
 
 		// nil for ignore
 		if userAuthMsg != nil {
+			method := userAuthMsg.Method
+
 			err = pipe.upstream.transport.writePacket(Marshal(userAuthMsg))
 			if err != nil {
 				return err
@@ -409,13 +628,46 @@ func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
 				return err
 			}
 
-			success := packet[0] == msgUserAuthSuccess
+			if pipe.metrics != nil {
+				pipe.metrics(MetricsEvent{
+					Type:           MetricsAuthAttempt,
+					SessionID:      pipe.sessionID,
+					DownstreamUser: pipe.downstream.user,
+					UpstreamUser:   pipe.mappedUser,
+					RemoteAddr:     pipe.downstream.RemoteAddr().String(),
+					Method:         method,
+					Result:         authAttemptResult(packet),
+				})
+			}
+
+			if method == "keyboard-interactive" && len(packet) > 0 && packet[0] == msgUserAuthInfoRequest {
+				done, err := pipe.relayKeyboardInteractive(packet)
+				if err != nil {
+					return err
+				}
+
+				if done {
+					return nil
+				}
+
+				userAuthMsg, err = pipe.downstream.nextAuthMsg()
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			done, err := pipe.drainExtraAuth(&packet)
+			if err != nil {
+				return err
+			}
 
 			if err = pipe.downstream.transport.writePacket(packet); err != nil {
 				return err
 			}
 
-			if success {
+			if done || packet[0] == msgUserAuthSuccess {
 				return nil
 			}
 		}
@@ -428,6 +680,147 @@ func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
 	}
 }
 
+// keyboardInteractiveAnswers returns the answers relayKeyboardInteractive
+// should send upstream for a round of prompts: mapped as-is on success,
+// or one empty answer per prompt if mapKeyboardInteractive errored, so
+// upstream's own auth failure propagates naturally instead of killing
+// the whole connection on a transient hook failure (e.g. a vault lookup
+// timeout) -- the same degrade MapPublicKey/MapPassword get.
+func keyboardInteractiveAnswers(prompts, mapped []string, err error) []string {
+	if err != nil {
+		return make([]string, len(prompts))
+	}
+
+	return mapped
+}
+
+// relayKeyboardInteractive drives a keyboard-interactive round trip with
+// upstream starting from its first SSH_MSG_USERAUTH_INFO_REQUEST packet,
+// letting mapKeyboardInteractive translate prompts/answers instead of
+// relaying them verbatim. Upstream's final reply, success or failure, is
+// relayed to downstream; it returns true if that reply is success.
+func (pipe *pipedConn) relayKeyboardInteractive(packet []byte) (bool, error) {
+	for {
+		name, instruction, prompts, echos, err := parseInfoRequestMsg(packet)
+		if err != nil {
+			return false, err
+		}
+
+		var answers []string
+
+		if pipe.mapKeyboardInteractive != nil {
+			mapped, mapErr := pipe.mapKeyboardInteractive(pipe.downstream, name, instruction, prompts, echos)
+			answers = keyboardInteractiveAnswers(prompts, mapped, mapErr)
+		} else {
+			if err := pipe.downstream.transport.writePacket(packet); err != nil {
+				return false, err
+			}
+
+			respPacket, err := pipe.downstream.transport.readPacket()
+			if err != nil {
+				return false, err
+			}
+
+			answers, err = parseInfoResponseMsg(respPacket)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if err := pipe.upstream.transport.writePacket(marshalInfoResponseMsg(answers)); err != nil {
+			return false, err
+		}
+
+		packet, err = pipe.upstream.transport.readPacket()
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case len(packet) == 0:
+			return false, fmt.Errorf("ssh: empty response during keyboard-interactive")
+		case packet[0] == msgUserAuthInfoRequest:
+			continue
+		}
+
+		if pipe.metrics != nil {
+			pipe.metrics(MetricsEvent{
+				Type:           MetricsAuthAttempt,
+				SessionID:      pipe.sessionID,
+				DownstreamUser: pipe.downstream.user,
+				UpstreamUser:   pipe.mappedUser,
+				RemoteAddr:     pipe.downstream.RemoteAddr().String(),
+				Method:         "keyboard-interactive",
+				Result:         authAttemptResult(packet),
+			})
+		}
+
+		if err := pipe.downstream.transport.writePacket(packet); err != nil {
+			return false, err
+		}
+		return packet[0] == msgUserAuthSuccess, nil
+	}
+}
+
+// drainExtraAuth consumes ExtraAuth steps queued by MapPublicKey (e.g. a
+// vaulted password presented upstream after pubkey auth) for as long as
+// upstream keeps reporting partial success. packet is updated in place to
+// the final response that should be relayed to downstream; the returned
+// bool is true once upstream reports full success.
+func (pipe *pipedConn) drainExtraAuth(packet *[]byte) (bool, error) {
+	for len(pipe.extraAuth) > 0 {
+		if len(*packet) == 0 || (*packet)[0] != msgUserAuthFailure {
+			return false, nil
+		}
+
+		var failure userAuthFailureMsg
+		if err := Unmarshal(*packet, &failure); err != nil {
+			return false, err
+		}
+
+		if !failure.PartialSuccess {
+			return false, nil
+		}
+
+		next := pipe.extraAuth[0]
+		pipe.extraAuth = pipe.extraAuth[1:]
+
+		req, err := next.buildRequest(pipe.mappedUser)
+		if err != nil {
+			return false, err
+		}
+
+		if err := pipe.upstream.transport.writePacket(Marshal(req)); err != nil {
+			return false, err
+		}
+
+		resp, err := pipe.upstream.transport.readPacket()
+		if err != nil {
+			return false, err
+		}
+
+		*packet = resp
+
+		if pipe.metrics != nil {
+			pipe.metrics(MetricsEvent{
+				Type:           MetricsAuthAttempt,
+				SessionID:      pipe.sessionID,
+				DownstreamUser: pipe.downstream.user,
+				UpstreamUser:   pipe.mappedUser,
+				RemoteAddr:     pipe.downstream.RemoteAddr().String(),
+				Method:         string(next.Method),
+				Result:         authAttemptResult(resp),
+			})
+		}
+
+		if len(resp) > 0 && resp[0] == msgUserAuthSuccess {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (u *upstream) sendAuthReq() error {
 	if err := u.transport.writePacket(Marshal(&serviceRequestMsg{serviceUserAuth})); err != nil {
 		return err
@@ -502,6 +895,21 @@ func noneAuthMsg(user string) *userAuthRequestMsg {
 	}
 }
 
+// passwordAuthMsg turns MapPassword's outcome into the message pipeAuth
+// should forward upstream: msg with the mapped password on success, or
+// a none-auth message so a failed mapping fails only this auth attempt
+// -- matching MapPublicKey's degrade -- instead of closing the
+// connection.
+func passwordAuthMsg(msg *userAuthRequestMsg, mappedUser string, mapped []byte, isChange bool, err error) *userAuthRequestMsg {
+	if err != nil {
+		return noneAuthMsg(msg.User)
+	}
+
+	msg.User = mappedUser
+	msg.Payload = marshalPasswordPayload(mapped, isChange)
+	return msg
+}
+
 func (c *connection) clientHandshakeNoAuth(dialAddress string, config *ClientConfig) error {
 	c.clientVersion = []byte(packageVersion)
 	if config.ClientVersion != "" {
@@ -0,0 +1,222 @@
+// Copyright 2014, 2015 tgic<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package metrics turns the ssh.MetricsEvent stream a piped connection
+// emits into Prometheus collectors, and serves them alongside a
+// "/sessions" JSON endpoint listing the connections currently piped, the
+// kind of operational surface Tailscale exposes via clientmetric.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/tg123/sshpiper/ssh"
+)
+
+// Collector turns ssh.MetricsEvents into Prometheus collectors and a live
+// registry of piped sessions. The zero value is not usable; build one
+// with NewCollector.
+type Collector struct {
+	connectionsTotal  *prometheus.CounterVec
+	activeConnections prometheus.Gauge
+	authAttemptsTotal *prometheus.CounterVec
+	upstreamDialSecs  prometheus.Histogram
+	bytesTotal        *prometheus.CounterVec
+	channelsOpen      *prometheus.GaugeVec
+	handshakeSecs     prometheus.Histogram
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// Session is a snapshot of one live piped connection, as listed by the
+// "/sessions" endpoint.
+type Session struct {
+	SessionID       string    `json:"session_id"`
+	DownstreamUser  string    `json:"downstream_user"`
+	UpstreamUser    string    `json:"upstream_user"`
+	RemoteAddr      string    `json:"remote_addr"`
+	StartTime       time.Time `json:"start_time"`
+	BytesUpstream   int64     `json:"bytes_upstream"`
+	BytesDownstream int64     `json:"bytes_downstream"`
+}
+
+// NewCollector builds a Collector and registers its metrics with reg. Use
+// Collector.Hook as SSHPiperConfig.Metrics to feed it.
+func NewCollector(reg prometheus.Registerer) *Collector {
+	c := &Collector{
+		connectionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshpiper_connections_total",
+			Help: "Total number of piped connections attempted, by result.",
+		}, []string{"result"}),
+
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sshpiper_active_connections",
+			Help: "Number of piped connections currently established.",
+		}),
+
+		authAttemptsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshpiper_auth_attempts_total",
+			Help: "Total number of auth attempts relayed to upstream, by method and result.",
+		}, []string{"method", "result"}),
+
+		upstreamDialSecs: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "sshpiper_upstream_dial_seconds",
+			Help: "Time spent on the ssh handshake with the upstream server, not including the TCP dial.",
+		}),
+
+		bytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshpiper_bytes_total",
+			Help: "Total bytes relayed over piped channels, by direction.",
+		}, []string{"direction"}),
+
+		channelsOpen: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshpiper_channels_open",
+			Help: "Number of channels currently open, by channel type.",
+		}, []string{"type"}),
+
+		handshakeSecs: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "sshpiper_handshake_seconds",
+			Help: "Time spent establishing a piped connection, from accept to either auth success or failure.",
+		}),
+
+		sessions: map[string]*Session{},
+	}
+
+	reg.MustRegister(
+		c.connectionsTotal,
+		c.activeConnections,
+		c.authAttemptsTotal,
+		c.upstreamDialSecs,
+		c.bytesTotal,
+		c.channelsOpen,
+		c.handshakeSecs,
+	)
+
+	return c
+}
+
+// Hook is an ssh.MetricsHook that updates the collector's metrics and
+// session registry for event.
+func (c *Collector) Hook(event ssh.MetricsEvent) {
+	switch event.Type {
+	case ssh.MetricsConnection:
+		c.connectionsTotal.WithLabelValues(event.Result).Inc()
+		if event.Result == "success" {
+			c.activeConnections.Inc()
+		}
+
+	case ssh.MetricsConnectionClosed:
+		c.activeConnections.Dec()
+		c.removeSession(event.SessionID)
+
+	case ssh.MetricsHandshake:
+		c.handshakeSecs.Observe(event.Duration.Seconds())
+
+	case ssh.MetricsUpstreamDial:
+		c.upstreamDialSecs.Observe(event.Duration.Seconds())
+
+	case ssh.MetricsAuthAttempt:
+		c.authAttemptsTotal.WithLabelValues(event.Method, event.Result).Inc()
+		if event.Result == "success" {
+			c.addSession(event)
+		}
+
+	case ssh.MetricsChannelOpen:
+		c.channelsOpen.WithLabelValues(event.ChannelType).Inc()
+
+	case ssh.MetricsChannelClose:
+		c.channelsOpen.WithLabelValues(event.ChannelType).Dec()
+
+	case ssh.MetricsBytesTransferred:
+		c.bytesTotal.WithLabelValues(event.Direction).Add(float64(event.Bytes))
+		c.addBytes(event)
+	}
+}
+
+func (c *Collector) addSession(event ssh.MetricsEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sessions[event.SessionID]; ok {
+		return
+	}
+
+	c.sessions[event.SessionID] = &Session{
+		SessionID:      event.SessionID,
+		DownstreamUser: event.DownstreamUser,
+		UpstreamUser:   event.UpstreamUser,
+		RemoteAddr:     event.RemoteAddr,
+		StartTime:      time.Now(),
+	}
+}
+
+func (c *Collector) addBytes(event ssh.MetricsEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sessions[event.SessionID]
+	if !ok {
+		return
+	}
+
+	if event.Direction == "upstream" {
+		s.BytesUpstream += int64(event.Bytes)
+	} else {
+		s.BytesDownstream += int64(event.Bytes)
+	}
+}
+
+func (c *Collector) removeSession(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sessions, sessionID)
+}
+
+// Sessions returns a snapshot of every piped connection currently live,
+// in no particular order.
+func (c *Collector) Sessions() []*Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		cp := *s
+		sessions = append(sessions, &cp)
+	}
+
+	return sessions
+}
+
+func (c *Collector) serveSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Sessions()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ListenAndServe starts an admin HTTP listener on addr serving "/metrics"
+// (the Prometheus collectors registered with reg) and "/sessions" (a JSON
+// list of live piped connections tracked by c). It blocks until the
+// listener fails.
+func ListenAndServe(addr string, reg *prometheus.Registry, c *Collector) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/sessions", c.serveSessions)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("metrics: admin listener: %v", err)
+	}
+
+	return nil
+}